@@ -0,0 +1,452 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gps
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/nomango/dep/gps/pkgtree"
+	"github.com/pkg/errors"
+)
+
+var (
+	bktManifestAndLock = []byte(sqlKindManifestAndLock)
+	bktPackageTree     = []byte(sqlKindPackageTree)
+	bktVersions        = []byte(sqlKindVersions)
+	bktRevisionExists  = []byte(sqlKindRevisionExists)
+	bktSchema          = []byte("schema")
+
+	schemaVersionKey = []byte("version")
+)
+
+// ErrIncompatible is returned by a cacheMigration's Migrate method to
+// signal that the on-disk data it found can't be upgraded in place.
+// newBoltCache responds by wiping the cache and rebuilding it from scratch,
+// the way every epoch change used to - but only as a last resort, instead
+// of on every gps release that so much as tweaks an on-disk struct.
+var ErrIncompatible = errors.New("gps: cache data is incompatible with this version of gps")
+
+// cacheMigration upgrades a persistent cache from the schema version
+// immediately below Version() to Version() itself.
+//
+// Migrate takes a *bolt.Tx, so this registry only runs against boltCache.
+// sqlCache stamps the same currentCacheSchemaVersion() number onto its own
+// data (see sql_cache.go's createSchema), but it never executes a
+// cacheMigration itself - on any version mismatch, newer or older, it
+// wipes gps_cache_entries and rebuilds instead of migrating in place.
+type cacheMigration interface {
+	// Version is the schema version this migration upgrades the database
+	// to. Migrations run in ascending Version() order.
+	Version() int
+	// Migrate transforms tx's buckets in place. Returning ErrIncompatible
+	// (directly or wrapped) tells newBoltCache the database can't be
+	// salvaged and should be wiped instead.
+	Migrate(tx *bolt.Tx) error
+}
+
+// cacheMigrations is the registry of migrations newBoltCache runs, in
+// order, when it finds an older schema version on open.
+var cacheMigrations []cacheMigration
+
+// registerCacheMigration adds m to the registry. Migrations must be
+// registered in increasing Version() order.
+func registerCacheMigration(m cacheMigration) {
+	cacheMigrations = append(cacheMigrations, m)
+}
+
+// currentCacheSchemaVersion is the schema version a cache should be at once
+// every registered migration has run.
+func currentCacheSchemaVersion() int {
+	if len(cacheMigrations) == 0 {
+		return 0
+	}
+	return cacheMigrations[len(cacheMigrations)-1].Version()
+}
+
+func init() {
+	registerCacheMigration(migrationV1{})
+}
+
+// migrationV1 establishes the original bucket layout: one bucket per kind
+// of cached data, keyed by source/revision/analyzer.
+type migrationV1 struct{}
+
+func (migrationV1) Version() int { return 1 }
+
+func (migrationV1) Migrate(tx *bolt.Tx) error {
+	for _, name := range [][]byte{bktManifestAndLock, bktPackageTree, bktVersions, bktRevisionExists} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return errors.Wrapf(err, "failed to create %s bucket", name)
+		}
+	}
+	return nil
+}
+
+// boltCache is a sourceCache persisted to a local bolt database. epoch is
+// still honored per-entry (an entry written under a different epoch is
+// treated as a miss, the same way it always has been), but a change in the
+// on-disk *shape* of the data no longer wipes the whole cache - it's
+// handled by running any pending cacheMigrations instead.
+type boltCache struct {
+	epoch  int64
+	logger *log.Logger
+	db     *bolt.DB
+}
+
+// newBoltCache opens (creating if necessary) the bolt database under
+// cachedir. On open it runs any cacheMigrations the database is missing,
+// in a single transaction, falling back to wiping and rebuilding only if a
+// migration reports the data as ErrIncompatible.
+func newBoltCache(cachedir string, epoch int64, logger *log.Logger) (*boltCache, error) {
+	db, err := bolt.Open(filepath.Join(cachedir, "cache.boltdb"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open bolt cache")
+	}
+
+	c := &boltCache{epoch: epoch, logger: logger, db: db}
+	if err := c.openOrMigrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *boltCache) openOrMigrate() error {
+	var storedVersion int
+	var found bool
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		sb := tx.Bucket(bktSchema)
+		if sb == nil {
+			return nil
+		}
+		if v := sb.Get(schemaVersionKey); v != nil {
+			storedVersion = int(binary.BigEndian.Uint64(v))
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	target := currentCacheSchemaVersion()
+	if !found {
+		return c.runMigrations(0, target)
+	}
+	if storedVersion == target {
+		return nil
+	}
+	if storedVersion > target {
+		// A newer gps wrote this cache than we know how to read; safest is
+		// to treat it the way an unparseable migration result would be.
+		c.logger.Println("gps: cache schema is newer than this version of gps understands, rebuilding")
+		return c.wipeAndRebuild(target)
+	}
+
+	if err := c.backup(); err != nil {
+		c.logger.Println("gps: failed to back up cache before migrating, continuing anyway:", err)
+	}
+
+	if err := c.runMigrations(storedVersion, target); err != nil {
+		if errors.Cause(err) == ErrIncompatible {
+			c.logger.Println("gps: cache data is incompatible with this version of gps, rebuilding:", err)
+			return c.wipeAndRebuild(target)
+		}
+		return err
+	}
+	return nil
+}
+
+// runMigrations runs every registered migration after "from" up to and
+// including "to" in a single transaction, then stamps the schema version.
+func (c *boltCache) runMigrations(from, to int) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, m := range cacheMigrations {
+			if m.Version() <= from || m.Version() > to {
+				continue
+			}
+			if err := m.Migrate(tx); err != nil {
+				return err
+			}
+		}
+
+		sb, err := tx.CreateBucketIfNotExists(bktSchema)
+		if err != nil {
+			return err
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(to))
+		return sb.Put(schemaVersionKey, v)
+	})
+}
+
+// backup copies the current database alongside itself before a migration
+// runs, so a failed migration doesn't destroy the only copy of the cache.
+func (c *boltCache) backup() error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(c.db.Path()+".bak", 0644)
+	})
+}
+
+// wipeAndRebuild discards the database entirely and starts over at schema
+// version target. It's the fallback path for data a migration can't save.
+func (c *boltCache) wipeAndRebuild(target int) error {
+	path := c.db.Path()
+	if err := c.db.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	c.db = db
+	return c.runMigrations(0, target)
+}
+
+func (c *boltCache) close() error {
+	return c.db.Close()
+}
+
+func (c *boltCache) newSingleSourceCache(pi ProjectIdentifier) singleSourceCache {
+	return boltSingleSourceCache{c: c, source: string(pi.ProjectRoot)}
+}
+
+// boltEnvelope wraps every value stored in the cache with the epoch it was
+// written under, so a get can treat a stale epoch as a miss without
+// needing to touch any other entry.
+type boltEnvelope struct {
+	Epoch int64
+	Data  []byte
+}
+
+func (c *boltCache) get(bucket []byte, key string) ([]byte, bool) {
+	var data []byte
+	var ok bool
+
+	if err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		raw := b.Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+
+		var env boltEnvelope
+		if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&env); err != nil {
+			return errors.Wrap(err, "failed to decode cache entry")
+		}
+		if env.Epoch != c.epoch {
+			return nil
+		}
+		data, ok = env.Data, true
+		return nil
+	}); err != nil {
+		c.logger.Println("gps: bolt cache: get failed:", err)
+		return nil, false
+	}
+	return data, ok
+}
+
+func (c *boltCache) set(bucket []byte, key string, data []byte) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(boltEnvelope{Epoch: c.epoch, Data: data}); err != nil {
+		return errors.Wrap(err, "failed to encode cache entry")
+	}
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), buf.Bytes())
+	})
+}
+
+func boltKey(source string, rev Revision, ai ProjectAnalyzerInfo) string {
+	return source + "\x00" + string(rev) + "\x00" + ai.Name + "\x00" + strconv.Itoa(ai.Version)
+}
+
+type boltSingleSourceCache struct {
+	c      *boltCache
+	source string
+}
+
+func (sc boltSingleSourceCache) setManifestAndLock(r Revision, ai ProjectAnalyzerInfo, m Manifest, l Lock) {
+	data, err := encodeManifestAndLock(m, l)
+	if err != nil {
+		sc.c.logger.Println("gps: bolt cache: failed to encode manifest and lock:", err)
+		return
+	}
+
+	if err := sc.c.set(bktManifestAndLock, boltKey(sc.source, r, ai), data); err != nil {
+		sc.c.logger.Println("gps: bolt cache: failed to store manifest and lock:", err)
+	}
+}
+
+func (sc boltSingleSourceCache) getManifestAndLock(r Revision, ai ProjectAnalyzerInfo) (Manifest, Lock, bool) {
+	data, ok := sc.c.get(bktManifestAndLock, boltKey(sc.source, r, ai))
+	if !ok {
+		return nil, nil, false
+	}
+
+	m, l, err := decodeManifestAndLock(data)
+	if err != nil {
+		sc.c.logger.Println("gps: bolt cache: failed to decode manifest and lock:", err)
+		return nil, nil, false
+	}
+	return m, l, true
+}
+
+func (sc boltSingleSourceCache) setPackageTree(r Revision, pt pkgtree.PackageTree) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(pt); err != nil {
+		sc.c.logger.Println("gps: bolt cache: failed to encode package tree:", err)
+		return
+	}
+	if err := sc.c.set(bktPackageTree, boltKey(sc.source, r, ProjectAnalyzerInfo{}), buf.Bytes()); err != nil {
+		sc.c.logger.Println("gps: bolt cache: failed to store package tree:", err)
+	}
+}
+
+func (sc boltSingleSourceCache) getPackageTree(r Revision, pr ProjectRoot) (pkgtree.PackageTree, bool) {
+	data, ok := sc.c.get(bktPackageTree, boltKey(sc.source, r, ProjectAnalyzerInfo{}))
+	if !ok {
+		return pkgtree.PackageTree{}, false
+	}
+	var pt pkgtree.PackageTree
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&pt); err != nil {
+		sc.c.logger.Println("gps: bolt cache: failed to decode package tree:", err)
+		return pkgtree.PackageTree{}, false
+	}
+	return pt, true
+}
+
+func (sc boltSingleSourceCache) markRevisionExists(r Revision) {
+	if err := sc.c.set(bktRevisionExists, boltKey(sc.source, r, ProjectAnalyzerInfo{}), []byte{1}); err != nil {
+		sc.c.logger.Println("gps: bolt cache: failed to mark revision as existing:", err)
+	}
+}
+
+func (sc boltSingleSourceCache) setVersionMap(versionList []PairedVersion) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(len(versionList)); err != nil {
+		sc.c.logger.Println("gps: bolt cache: failed to encode version map:", err)
+		return
+	}
+	for _, v := range versionList {
+		uv := v.Unpair()
+		if err := enc.Encode(struct {
+			Str string
+			Rev Revision
+			Typ VersionType
+		}{uv.String(), v.Revision(), uv.Type()}); err != nil {
+			sc.c.logger.Println("gps: bolt cache: failed to encode version map:", err)
+			return
+		}
+	}
+	if err := sc.c.set(bktVersions, boltKey(sc.source, "", ProjectAnalyzerInfo{}), buf.Bytes()); err != nil {
+		sc.c.logger.Println("gps: bolt cache: failed to store version map:", err)
+	}
+}
+
+func (sc boltSingleSourceCache) getAllVersions() ([]PairedVersion, bool) {
+	data, ok := sc.c.get(bktVersions, boltKey(sc.source, "", ProjectAnalyzerInfo{}))
+	if !ok {
+		return nil, false
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	var n int
+	if err := dec.Decode(&n); err != nil {
+		sc.c.logger.Println("gps: bolt cache: failed to decode version map:", err)
+		return nil, false
+	}
+
+	out := make([]PairedVersion, 0, n)
+	for i := 0; i < n; i++ {
+		var raw struct {
+			Str string
+			Rev Revision
+			Typ VersionType
+		}
+		if err := dec.Decode(&raw); err != nil {
+			sc.c.logger.Println("gps: bolt cache: failed to decode version map:", err)
+			return nil, false
+		}
+		out = append(out, deducePairedVersion(raw.Str, raw.Rev, raw.Typ))
+	}
+	return out, true
+}
+
+func (sc boltSingleSourceCache) getVersionsFor(r Revision) ([]UnpairedVersion, bool) {
+	all, ok := sc.getAllVersions()
+	if !ok {
+		return nil, false
+	}
+	var uvs []UnpairedVersion
+	for _, pv := range all {
+		if pv.Revision() == r {
+			uvs = append(uvs, pv.Unpair())
+		}
+	}
+	return uvs, len(uvs) > 0
+}
+
+func (sc boltSingleSourceCache) getRevisionFor(uv UnpairedVersion) (Revision, bool) {
+	all, ok := sc.getAllVersions()
+	if !ok {
+		return "", false
+	}
+	for _, pv := range all {
+		if pv.Unpair().identical(uv) {
+			return pv.Revision(), true
+		}
+	}
+	return "", false
+}
+
+func (sc boltSingleSourceCache) toRevision(v Version) (Revision, bool) {
+	switch t := v.(type) {
+	case Revision:
+		return t, true
+	case PairedVersion:
+		return t.Revision(), true
+	case UnpairedVersion:
+		return sc.getRevisionFor(t)
+	}
+	return "", false
+}
+
+func (sc boltSingleSourceCache) toUnpaired(v Version) (UnpairedVersion, bool) {
+	switch t := v.(type) {
+	case UnpairedVersion:
+		return t, true
+	case PairedVersion:
+		return t.Unpair(), true
+	case Revision:
+		uvs, ok := sc.getVersionsFor(t)
+		if !ok || len(uvs) == 0 {
+			return nil, false
+		}
+		return uvs[0], true
+	}
+	return nil, false
+}
@@ -0,0 +1,322 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gps
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"fmt"
+	"sync"
+
+	"github.com/nomango/dep/gps/pkgtree"
+)
+
+const (
+	lruKindManifestAndLock = "manifestAndLock"
+	lruKindPackageTree     = "packageTree"
+	lruKindVersions        = "versions"
+)
+
+// lruEvictCallback is invoked whenever lruMemoryCache evicts an entry
+// holding "hot" per-revision data (a manifest/lock pair or a package tree),
+// so that an outer tier such as multiCache can decide whether to demote the
+// entry to its slower, persistent tier instead of losing it outright.
+type lruEvictCallback func(pi ProjectIdentifier, rev Revision, kind string, data interface{})
+
+// lruMemoryCache is a sourceCache that holds the same data as memoryCache,
+// but bounds its footprint to roughly maxBytes by evicting the
+// least-recently-used entries once that budget is exceeded. It exists
+// because memoryCache grows without bound as new singleSourceCache entries
+// accumulate, which can dominate RSS for large workspaces resolving
+// hundreds of transitive projects.
+//
+// Size accounting and eviction are modelled on go-git's plumbing/cache
+// package (BufferLRU/ObjectLRU): every set* call estimates the bytes it
+// adds and pushes an entry to the front of an MRU list keyed by
+// (ProjectIdentifier, Revision, kind); once the running total exceeds
+// maxBytes, entries are evicted from the back of the list until the cache
+// is back under budget.
+type lruMemoryCache struct {
+	mu sync.Mutex
+
+	maxBytes int64
+	curBytes int64
+
+	order *list.List // front = most recently used
+	index map[lruEntryKey]*list.Element
+
+	onEvict lruEvictCallback
+}
+
+type lruEntryKey struct {
+	pi   ProjectIdentifier
+	rev  Revision
+	kind string
+	ai   ProjectAnalyzerInfo // only meaningful for kind == lruKindManifestAndLock
+}
+
+type lruEntryValue struct {
+	key  lruEntryKey
+	size int64
+	data interface{}
+}
+
+// newLRUMemoryCache returns a sourceCache backed by an in-memory LRU with a
+// byte budget of maxBytes. A maxBytes of zero or less disables eviction,
+// in which case the cache behaves like an unbounded memoryCache.
+func newLRUMemoryCache(maxBytes int64) *lruMemoryCache {
+	return &lruMemoryCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		index:    make(map[lruEntryKey]*list.Element),
+	}
+}
+
+// withEvictCallback registers fn to be called with the data of any "hot"
+// per-revision entry this cache evicts, and returns c for chaining.
+func (c *lruMemoryCache) withEvictCallback(fn lruEvictCallback) *lruMemoryCache {
+	c.onEvict = fn
+	return c
+}
+
+func (c *lruMemoryCache) newSingleSourceCache(pi ProjectIdentifier) singleSourceCache {
+	return lruSingleSourceCache{pi: pi, c: c}
+}
+
+func (c *lruMemoryCache) close() error { return nil }
+
+// set inserts or replaces the entry for key, then evicts from the back of
+// the LRU until the cache is back under maxBytes. Any onEvict callbacks for
+// entries that eviction drops run after c.mu is released - see evict.
+func (c *lruMemoryCache) set(key lruEntryKey, size int64, data interface{}) {
+	c.mu.Lock()
+
+	if el, ok := c.index[key]; ok {
+		c.curBytes -= el.Value.(*lruEntryValue).size
+		el.Value = &lruEntryValue{key: key, size: size, data: data}
+		c.order.MoveToFront(el)
+	} else {
+		c.index[key] = c.order.PushFront(&lruEntryValue{key: key, size: size, data: data})
+	}
+	c.curBytes += size
+
+	evicted := c.evict()
+	c.mu.Unlock()
+
+	for _, ev := range evicted {
+		c.onEvict(ev.key.pi, ev.key.rev, ev.key.kind, ev.data)
+	}
+}
+
+func (c *lruMemoryCache) get(key lruEntryKey) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntryValue).data, true
+}
+
+// evict drops entries from the back of the LRU until curBytes is back
+// under maxBytes, but never evicts the most-recently-used entry: a single
+// entry bigger than maxBytes (or the one set() just wrote) must stay
+// retrievable rather than being evicted out from under the call that just
+// wrote it. It returns the dropped "hot" entries (manifest/lock pairs and
+// package trees) that have an onEvict callback registered, rather than
+// invoking the callback itself - onEvict may do a blocking slow-tier write,
+// and running that while still holding c.mu would stall every other
+// reader and writer of the fast tier for the duration. Callers must hold
+// c.mu, and must call onEvict for the returned entries only after
+// releasing it.
+func (c *lruMemoryCache) evict() []*lruEntryValue {
+	if c.maxBytes <= 0 {
+		return nil
+	}
+	var evicted []*lruEntryValue
+	for c.curBytes > c.maxBytes && c.order.Len() > 1 {
+		el := c.order.Back()
+		ev := el.Value.(*lruEntryValue)
+		c.order.Remove(el)
+		delete(c.index, ev.key)
+		c.curBytes -= ev.size
+
+		if c.onEvict != nil && (ev.key.kind == lruKindManifestAndLock || ev.key.kind == lruKindPackageTree) {
+			evicted = append(evicted, ev)
+		}
+	}
+	return evicted
+}
+
+// lruSingleSourceCache is the singleSourceCache view of an lruMemoryCache
+// for a single ProjectIdentifier.
+type lruSingleSourceCache struct {
+	pi ProjectIdentifier
+	c  *lruMemoryCache
+}
+
+type manifestAndLock struct {
+	ai ProjectAnalyzerInfo
+	m  Manifest
+	l  Lock
+}
+
+func (c lruSingleSourceCache) setManifestAndLock(r Revision, ai ProjectAnalyzerInfo, m Manifest, l Lock) {
+	c.c.set(lruEntryKey{pi: c.pi, rev: r, kind: lruKindManifestAndLock, ai: ai}, estimateManifestAndLockSize(m, l), manifestAndLock{ai: ai, m: m, l: l})
+}
+
+func (c lruSingleSourceCache) getManifestAndLock(r Revision, ai ProjectAnalyzerInfo) (Manifest, Lock, bool) {
+	v, ok := c.c.get(lruEntryKey{pi: c.pi, rev: r, kind: lruKindManifestAndLock, ai: ai})
+	if !ok {
+		return nil, nil, false
+	}
+	ml := v.(manifestAndLock)
+	return ml.m, ml.l, true
+}
+
+func (c lruSingleSourceCache) setPackageTree(r Revision, pt pkgtree.PackageTree) {
+	c.c.set(lruEntryKey{pi: c.pi, rev: r, kind: lruKindPackageTree}, estimatePackageTreeSize(pt), pt)
+}
+
+func (c lruSingleSourceCache) getPackageTree(r Revision, pr ProjectRoot) (pkgtree.PackageTree, bool) {
+	v, ok := c.c.get(lruEntryKey{pi: c.pi, rev: r, kind: lruKindPackageTree})
+	if !ok {
+		return pkgtree.PackageTree{}, false
+	}
+	return v.(pkgtree.PackageTree), true
+}
+
+func (c lruSingleSourceCache) markRevisionExists(r Revision) {
+	c.c.set(lruEntryKey{pi: c.pi, rev: r, kind: lruKindVersions}, 0, struct{}{})
+}
+
+func (c lruSingleSourceCache) setVersionMap(versionList []PairedVersion) {
+	var size int64
+	for _, v := range versionList {
+		size += int64(len(v.String())) + int64(len(v.Revision()))
+	}
+	c.c.set(lruEntryKey{pi: c.pi, kind: lruKindVersions}, size, versionList)
+}
+
+func (c lruSingleSourceCache) getAllVersions() ([]PairedVersion, bool) {
+	v, ok := c.c.get(lruEntryKey{pi: c.pi, kind: lruKindVersions})
+	if !ok {
+		return nil, false
+	}
+	return v.([]PairedVersion), true
+}
+
+func (c lruSingleSourceCache) getVersionsFor(r Revision) ([]UnpairedVersion, bool) {
+	all, ok := c.getAllVersions()
+	if !ok {
+		return nil, false
+	}
+	var uvs []UnpairedVersion
+	for _, pv := range all {
+		if pv.Revision() == r {
+			uvs = append(uvs, pv.Unpair())
+		}
+	}
+	return uvs, len(uvs) > 0
+}
+
+func (c lruSingleSourceCache) getRevisionFor(uv UnpairedVersion) (Revision, bool) {
+	all, ok := c.getAllVersions()
+	if !ok {
+		return "", false
+	}
+	for _, pv := range all {
+		if pv.Unpair().identical(uv) {
+			return pv.Revision(), true
+		}
+	}
+	return "", false
+}
+
+func (c lruSingleSourceCache) toRevision(v Version) (Revision, bool) {
+	switch t := v.(type) {
+	case Revision:
+		return t, true
+	case PairedVersion:
+		return t.Revision(), true
+	case UnpairedVersion:
+		return c.getRevisionFor(t)
+	}
+	return "", false
+}
+
+func (c lruSingleSourceCache) toUnpaired(v Version) (UnpairedVersion, bool) {
+	switch t := v.(type) {
+	case UnpairedVersion:
+		return t, true
+	case PairedVersion:
+		return t.Unpair(), true
+	case Revision:
+		uvs, ok := c.getVersionsFor(t)
+		if !ok || len(uvs) == 0 {
+			return nil, false
+		}
+		return uvs[0], true
+	}
+	return nil, false
+}
+
+// estimateManifestAndLockSize approximates the number of bytes m and l
+// occupy in memory. Manifest and Lock are arbitrary implementations, so we
+// can't gob-encode them directly; a formatted dump is good enough for a
+// cache eviction heuristic.
+func estimateManifestAndLockSize(m Manifest, l Lock) int64 {
+	var buf bytes.Buffer
+	if m != nil {
+		fmt.Fprintf(&buf, "%#v", m)
+	}
+	if l != nil {
+		fmt.Fprintf(&buf, "%#v", l)
+	}
+	return int64(buf.Len())
+}
+
+// estimatePackageTreeSize approximates the number of bytes pt occupies by
+// gob-encoding it, falling back to a rough estimate if pt contains data
+// (such as arbitrary errors in a PackageOrErr) that isn't gob-encodable.
+func estimatePackageTreeSize(pt pkgtree.PackageTree) (size int64) {
+	defer func() {
+		if recover() != nil {
+			size = int64(len(pt.ImportRoot))
+			for k := range pt.Packages {
+				size += int64(len(k)) * 4
+			}
+		}
+	}()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(pt); err != nil {
+		return int64(len(pt.ImportRoot))
+	}
+	return int64(buf.Len())
+}
+
+// newLRUBackedMultiCache returns a multiCache whose fast tier is a bounded
+// lruMemoryCache of maxBytes, wired so that any "hot" entry (a
+// manifest/lock pair or a package tree) it evicts is demoted into slow
+// instead of being dropped outright - the composition lruMemoryCache's
+// evict callback exists for.
+func newLRUBackedMultiCache(maxBytes int64, slow sourceCache) *multiCache {
+	fast := newLRUMemoryCache(maxBytes)
+	fast.withEvictCallback(func(pi ProjectIdentifier, rev Revision, kind string, data interface{}) {
+		ssc := slow.newSingleSourceCache(pi)
+		switch kind {
+		case lruKindManifestAndLock:
+			ml := data.(manifestAndLock)
+			ssc.setManifestAndLock(rev, ml.ai, ml.m, ml.l)
+		case lruKindPackageTree:
+			ssc.setPackageTree(rev, data.(pkgtree.PackageTree))
+		}
+	})
+	return newMultiCache(fast, slow)
+}
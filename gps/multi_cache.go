@@ -0,0 +1,309 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gps
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nomango/dep/gps/pkgtree"
+)
+
+// multiCacheWriteQueueCap bounds how many distinct (pi, rev, op) writes can
+// be outstanding to the slow tier at once: enqueue blocks the caller once
+// the pending set reaches this size, unless the write it's adding replaces
+// one already queued under the same key (which never grows the queue). The
+// map is keyed by write identity, so a solve that re-touches the same
+// handful of revisions repeatedly never grows it much past the number of
+// distinct revisions involved.
+const multiCacheWriteQueueCap = 4096
+
+// multiCacheDebounce is how long enqueue lets the pending set sit quiet
+// before flushing it to the slow tier. Resetting the timer on every
+// enqueue call is what makes rapid repeated writes for the same key
+// coalesce into a single flushed write deterministically, rather than
+// racing a flush that happens to land mid-burst.
+const multiCacheDebounce = 20 * time.Millisecond
+
+// multiCache is a sourceCache that layers a fast, synchronous tier (usually
+// memoryCache) over a slower, persistent one (boltCache or sqlCache).
+// Reads and writes to the fast tier happen inline; writes to the slow tier
+// are coalesced by key and flushed from a background goroutine after
+// multiCacheDebounce of quiet, or immediately via Flush, so a solve that
+// re-touches many revisions doesn't pay for a synchronous bolt/SQL
+// transaction on every call.
+type multiCache struct {
+	fast, slow sourceCache
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[multiCacheWriteKey]multiCacheWrite
+	timer   *time.Timer
+
+	// wg tracks every flushPending call running on a goroutine of its own -
+	// the debounce timer firing, or an explicit Flush - so close() can wait
+	// for them to finish draining into the slow tier instead of racing a
+	// still-running flush against c.slow.close().
+	wg sync.WaitGroup
+
+	// flushMu serializes flushPending calls, so a flush that finds the
+	// pending set already taken waits for the flush writing it to finish.
+	flushMu sync.Mutex
+}
+
+// multiCacheWriteKey identifies a single logical write to the slow tier.
+// Two writes with the same key and identical inputs coalesce into one.
+type multiCacheWriteKey struct {
+	pi  ProjectIdentifier
+	rev Revision
+	ai  ProjectAnalyzerInfo
+	op  string
+}
+
+// multiCacheWrite is a deferred write to the slow tier's singleSourceCache
+// for pi.
+type multiCacheWrite func(singleSourceCache)
+
+func newMultiCache(fast, slow sourceCache) *multiCache {
+	c := &multiCache{
+		fast:    fast,
+		slow:    slow,
+		pending: make(map[multiCacheWriteKey]multiCacheWrite),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// flushPending writes out and clears every coalesced write queued so far.
+// It's safe to call concurrently (from the debounce timer and from Flush
+// at once): flushMu makes a second caller wait until the first has written
+// its batch, and the map swap happens under c.mu, so the second caller then
+// writes only what was queued in the meantime.
+func (c *multiCache) flushPending() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	batch := c.pending
+	c.pending = make(map[multiCacheWriteKey]multiCacheWrite)
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	byProject := make(map[ProjectIdentifier]singleSourceCache, len(batch))
+	for key, write := range batch {
+		ssc, ok := byProject[key.pi]
+		if !ok {
+			ssc = c.slow.newSingleSourceCache(key.pi)
+			byProject[key.pi] = ssc
+		}
+		write(ssc)
+	}
+}
+
+// timerFired runs when the debounce timer expires. It releases the timer
+// slot first, so the next enqueue call schedules a fresh timer, then
+// flushes. An enqueue that takes c.mu after the timer expired but before
+// timerFired does finds the expired timer still in the slot and Resets it,
+// which runs timerFired a second time; enqueue adds to c.wg for that run.
+func (c *multiCache) timerFired() {
+	defer c.wg.Done()
+	c.mu.Lock()
+	c.timer = nil
+	c.mu.Unlock()
+	c.flushPending()
+}
+
+// enqueue schedules write to run against the slow tier's singleSourceCache
+// for key.pi, debounced by multiCacheDebounce. A write already queued under
+// the same key is replaced, which is what gives repeated
+// setPackageTree/setManifestAndLock calls for the same revision their
+// coalescing behavior. If the pending set is already at capacity and key
+// isn't already in it, enqueue blocks until a flush makes room.
+func (c *multiCache) enqueue(key multiCacheWriteKey, write multiCacheWrite) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.pending) >= multiCacheWriteQueueCap {
+		if _, exists := c.pending[key]; exists {
+			break
+		}
+		c.cond.Wait()
+	}
+	c.pending[key] = write
+
+	if c.timer == nil {
+		c.wg.Add(1)
+		c.timer = time.AfterFunc(multiCacheDebounce, c.timerFired)
+	} else if !c.timer.Reset(multiCacheDebounce) {
+		// The timer had already expired, so Reset scheduled timerFired to
+		// run again; balance the extra wg.Done it will make.
+		c.wg.Add(1)
+	}
+}
+
+// Flush blocks until every write enqueued before the call returns has been
+// applied to the slow tier, or ctx is cancelled.
+func (c *multiCache) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.flushPending()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops the debounce timer, waits for any flush already in flight -
+// the timer having fired just as close runs, or a concurrent Flush - to
+// finish, flushes whatever's left pending, then closes both tiers. Waiting
+// on c.wg before closing the slow tier is what prevents a flush goroutine
+// from writing to it concurrently with, or after, c.slow.close().
+func (c *multiCache) close() error {
+	c.mu.Lock()
+	if c.timer != nil {
+		if c.timer.Stop() {
+			// The timer hadn't fired yet, so timerFired will never run
+			// for this scheduled call; balance the Add made when it was
+			// scheduled.
+			c.wg.Done()
+		}
+		c.timer = nil
+	}
+	c.mu.Unlock()
+
+	c.wg.Wait()
+	c.flushPending()
+
+	err := c.slow.close()
+	if ferr := c.fast.close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func (c *multiCache) newSingleSourceCache(pi ProjectIdentifier) singleSourceCache {
+	return multiSingleSourceCache{
+		pi:   pi,
+		fast: c.fast.newSingleSourceCache(pi),
+		mc:   c,
+	}
+}
+
+// multiSingleSourceCache is the singleSourceCache view of a multiCache for
+// a single ProjectIdentifier. Every read is served from the fast tier if
+// possible, falling back to the slow one; getManifestAndLock,
+// getPackageTree and getAllVersions also copy a slow-tier hit back into the
+// fast tier, the other reads do not. Every write updates the fast tier immediately and enqueues a
+// coalesced write to the slow tier.
+type multiSingleSourceCache struct {
+	pi   ProjectIdentifier
+	fast singleSourceCache
+	mc   *multiCache
+}
+
+func (c multiSingleSourceCache) slow() singleSourceCache {
+	return c.mc.slow.newSingleSourceCache(c.pi)
+}
+
+func (c multiSingleSourceCache) setManifestAndLock(r Revision, ai ProjectAnalyzerInfo, m Manifest, l Lock) {
+	c.fast.setManifestAndLock(r, ai, m, l)
+	key := multiCacheWriteKey{pi: c.pi, rev: r, ai: ai, op: "manifestAndLock"}
+	c.mc.enqueue(key, func(slow singleSourceCache) {
+		slow.setManifestAndLock(r, ai, m, l)
+	})
+}
+
+func (c multiSingleSourceCache) getManifestAndLock(r Revision, ai ProjectAnalyzerInfo) (Manifest, Lock, bool) {
+	if m, l, ok := c.fast.getManifestAndLock(r, ai); ok {
+		return m, l, true
+	}
+	m, l, ok := c.slow().getManifestAndLock(r, ai)
+	if ok {
+		c.fast.setManifestAndLock(r, ai, m, l)
+	}
+	return m, l, ok
+}
+
+func (c multiSingleSourceCache) setPackageTree(r Revision, pt pkgtree.PackageTree) {
+	c.fast.setPackageTree(r, pt)
+	key := multiCacheWriteKey{pi: c.pi, rev: r, op: "packageTree"}
+	c.mc.enqueue(key, func(slow singleSourceCache) {
+		slow.setPackageTree(r, pt)
+	})
+}
+
+func (c multiSingleSourceCache) getPackageTree(r Revision, pr ProjectRoot) (pkgtree.PackageTree, bool) {
+	if pt, ok := c.fast.getPackageTree(r, pr); ok {
+		return pt, true
+	}
+	pt, ok := c.slow().getPackageTree(r, pr)
+	if ok {
+		c.fast.setPackageTree(r, pt)
+	}
+	return pt, ok
+}
+
+func (c multiSingleSourceCache) markRevisionExists(r Revision) {
+	c.fast.markRevisionExists(r)
+	key := multiCacheWriteKey{pi: c.pi, rev: r, op: "revisionExists"}
+	c.mc.enqueue(key, func(slow singleSourceCache) {
+		slow.markRevisionExists(r)
+	})
+}
+
+func (c multiSingleSourceCache) setVersionMap(versionList []PairedVersion) {
+	c.fast.setVersionMap(versionList)
+	key := multiCacheWriteKey{pi: c.pi, op: "versions"}
+	c.mc.enqueue(key, func(slow singleSourceCache) {
+		slow.setVersionMap(versionList)
+	})
+}
+
+func (c multiSingleSourceCache) getVersionsFor(r Revision) ([]UnpairedVersion, bool) {
+	if uvs, ok := c.fast.getVersionsFor(r); ok {
+		return uvs, true
+	}
+	return c.slow().getVersionsFor(r)
+}
+
+func (c multiSingleSourceCache) getAllVersions() ([]PairedVersion, bool) {
+	if pvs, ok := c.fast.getAllVersions(); ok {
+		return pvs, true
+	}
+	pvs, ok := c.slow().getAllVersions()
+	if ok {
+		c.fast.setVersionMap(pvs)
+	}
+	return pvs, ok
+}
+
+func (c multiSingleSourceCache) getRevisionFor(uv UnpairedVersion) (Revision, bool) {
+	if r, ok := c.fast.getRevisionFor(uv); ok {
+		return r, true
+	}
+	return c.slow().getRevisionFor(uv)
+}
+
+func (c multiSingleSourceCache) toRevision(v Version) (Revision, bool) {
+	if r, ok := c.fast.toRevision(v); ok {
+		return r, true
+	}
+	return c.slow().toRevision(v)
+}
+
+func (c multiSingleSourceCache) toUnpaired(v Version) (UnpairedVersion, bool) {
+	if uv, ok := c.fast.toUnpaired(v); ok {
+		return uv, true
+	}
+	return c.slow().toUnpaired(v)
+}
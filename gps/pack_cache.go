@@ -0,0 +1,465 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gps
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nomango/dep/gps/pkgtree"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/mmap"
+)
+
+// packFingerprintSize is the length, in bytes, of a packIndexEntry's
+// fingerprint (a full SHA-1 sum, the same size go-git uses for object
+// hashes).
+const packFingerprintSize = 20
+
+type packFingerprint [packFingerprintSize]byte
+
+// packIndexEntry locates one cached value inside the pack file: byte range
+// [Offset, Offset+Length) holds its zstd-compressed gob payload.
+type packIndexEntry struct {
+	Fingerprint packFingerprint
+	Offset      int64
+	Length      int64
+}
+
+// packCache is a sourceCache modeled on go-git's packfile/idxfile approach:
+// a single append-only pack-<epoch>.gps blob file holds zstd-compressed gob
+// payloads, and a sorted pack-<epoch>.idx maps (project, revision, kind)
+// fingerprints to (offset, length) pairs within it. Reads mmap the pack and
+// binary-search the in-memory index; writes append. Because old writes for
+// a fingerprint are never overwritten in place, Repack periodically
+// compacts the pack file down to only the entries the index still points
+// at.
+//
+// This trades boltCache's transactional guarantees for read performance:
+// rsync- or CDN-distributing a warmed pack+idx pair for a CI fleet is a
+// plain file copy, and a cold read-mostly load is just an mmap plus a
+// binary search, with no B-tree page walk.
+type packCache struct {
+	mu sync.Mutex
+
+	dir    string
+	epoch  int64
+	logger *log.Logger
+
+	packPath string
+	idxPath  string
+
+	packFile *os.File
+	packMap  *mmap.ReaderAt
+	packSize int64
+
+	index []packIndexEntry // sorted by Fingerprint
+}
+
+func packPaths(dir string, epoch int64) (pack, idx string) {
+	base := fmt.Sprintf("pack-%d", epoch)
+	return filepath.Join(dir, base+".gps"), filepath.Join(dir, base+".idx")
+}
+
+// newPackCache opens (creating if necessary) the pack and index files for
+// epoch under cachedir.
+func newPackCache(cachedir string, epoch int64, logger *log.Logger) (*packCache, error) {
+	packPath, idxPath := packPaths(cachedir, epoch)
+
+	c := &packCache{
+		dir:      cachedir,
+		epoch:    epoch,
+		logger:   logger,
+		packPath: packPath,
+		idxPath:  idxPath,
+	}
+
+	if err := c.loadIndex(); err != nil {
+		return nil, errors.Wrap(err, "packCache: failed to load index")
+	}
+	if err := c.openPack(); err != nil {
+		return nil, errors.Wrap(err, "packCache: failed to open pack file")
+	}
+	return c, nil
+}
+
+func (c *packCache) openPack() error {
+	f, err := os.OpenFile(c.packPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.packFile = f
+	c.packSize = fi.Size()
+	return c.remap()
+}
+
+// remap (re)opens the mmap view of the pack file. It must be called after
+// every write, since the file has grown.
+func (c *packCache) remap() error {
+	if c.packMap != nil {
+		c.packMap.Close()
+		c.packMap = nil
+	}
+	if c.packSize == 0 {
+		return nil
+	}
+	m, err := mmap.Open(c.packPath)
+	if err != nil {
+		return err
+	}
+	c.packMap = m
+	return nil
+}
+
+func (c *packCache) loadIndex() error {
+	data, err := os.ReadFile(c.idxPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(&c.index)
+}
+
+func (c *packCache) saveIndex() error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c.index); err != nil {
+		return err
+	}
+	tmp := c.idxPath + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.idxPath)
+}
+
+func (c *packCache) find(fp packFingerprint) (packIndexEntry, bool) {
+	i := sort.Search(len(c.index), func(i int) bool {
+		return bytes.Compare(c.index[i].Fingerprint[:], fp[:]) >= 0
+	})
+	if i < len(c.index) && c.index[i].Fingerprint == fp {
+		return c.index[i], true
+	}
+	return packIndexEntry{}, false
+}
+
+// set appends value's zstd-compressed gob encoding to the pack, then
+// records or replaces fp's index entry.
+func (c *packCache) set(fp packFingerprint, value interface{}) error {
+	var raw bytes.Buffer
+	if err := gob.NewEncoder(&raw).Encode(value); err != nil {
+		return errors.Wrap(err, "failed to encode value")
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	compressed := enc.EncodeAll(raw.Bytes(), nil)
+	enc.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, err := c.packFile.Write(compressed)
+	if err != nil {
+		return errors.Wrap(err, "failed to append to pack file")
+	}
+	entry := packIndexEntry{Fingerprint: fp, Offset: c.packSize, Length: int64(n)}
+	c.packSize += int64(n)
+
+	i := sort.Search(len(c.index), func(i int) bool {
+		return bytes.Compare(c.index[i].Fingerprint[:], fp[:]) >= 0
+	})
+	if i < len(c.index) && c.index[i].Fingerprint == fp {
+		c.index[i] = entry // last write for this key wins
+	} else {
+		c.index = append(c.index, packIndexEntry{})
+		copy(c.index[i+1:], c.index[i:])
+		c.index[i] = entry
+	}
+
+	if err := c.remap(); err != nil {
+		return errors.Wrap(err, "failed to remap pack file")
+	}
+	return c.saveIndex()
+}
+
+func (c *packCache) get(fp packFingerprint, out interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.find(fp)
+	if !ok || c.packMap == nil {
+		return false
+	}
+
+	buf := make([]byte, entry.Length)
+	if _, err := c.packMap.ReadAt(buf, entry.Offset); err != nil {
+		c.logger.Println("packCache: failed to read entry:", err)
+		return false
+	}
+
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		c.logger.Println("packCache: failed to create decompressor:", err)
+		return false
+	}
+	defer dec.Close()
+
+	raw, err := dec.DecodeAll(buf, nil)
+	if err != nil {
+		c.logger.Println("packCache: failed to decompress entry:", err)
+		return false
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(out); err != nil {
+		c.logger.Println("packCache: failed to decode entry:", err)
+		return false
+	}
+	return true
+}
+
+// Repack rewrites the pack file containing only the data the index still
+// points to, reclaiming space from superseded writes, then atomically
+// swaps it in for the live one.
+func (c *packCache) Repack() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmpPath := c.packPath + ".repack"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	newIndex := make([]packIndexEntry, len(c.index))
+	var offset int64
+	for i, entry := range c.index {
+		buf := make([]byte, entry.Length)
+		if _, err := c.packMap.ReadAt(buf, entry.Offset); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return errors.Wrap(err, "failed to read live entry during repack")
+		}
+		if _, err := tmp.Write(buf); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		newIndex[i] = packIndexEntry{Fingerprint: entry.Fingerprint, Offset: offset, Length: entry.Length}
+		offset += entry.Length
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if c.packMap != nil {
+		c.packMap.Close()
+		c.packMap = nil
+	}
+	if err := c.packFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, c.packPath); err != nil {
+		return err
+	}
+
+	c.index = newIndex
+	if err := c.saveIndex(); err != nil {
+		return err
+	}
+	return c.openPack()
+}
+
+func (c *packCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	if c.packMap != nil {
+		err = c.packMap.Close()
+	}
+	if ferr := c.packFile.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func (c *packCache) newSingleSourceCache(pi ProjectIdentifier) singleSourceCache {
+	return packSingleSourceCache{c: c, source: string(pi.ProjectRoot)}
+}
+
+func packFingerprintFor(kind, source string, rev Revision, ai ProjectAnalyzerInfo) packFingerprint {
+	var h hash.Hash = sha1.New()
+	io.WriteString(h, kind)
+	h.Write([]byte{0})
+	io.WriteString(h, source)
+	h.Write([]byte{0})
+	io.WriteString(h, string(rev))
+	h.Write([]byte{0})
+	io.WriteString(h, ai.Name)
+	h.Write([]byte{0})
+	binary.Write(h, binary.BigEndian, int64(ai.Version))
+
+	var fp packFingerprint
+	copy(fp[:], h.Sum(nil))
+	return fp
+}
+
+type packSingleSourceCache struct {
+	c      *packCache
+	source string
+}
+
+func (sc packSingleSourceCache) setManifestAndLock(r Revision, ai ProjectAnalyzerInfo, m Manifest, l Lock) {
+	fp := packFingerprintFor(sqlKindManifestAndLock, sc.source, r, ai)
+	if err := sc.c.set(fp, toCachedManifestAndLock(m, l)); err != nil {
+		sc.c.logger.Println("packCache: failed to store manifest and lock:", err)
+	}
+}
+
+func (sc packSingleSourceCache) getManifestAndLock(r Revision, ai ProjectAnalyzerInfo) (Manifest, Lock, bool) {
+	var payload manifestAndLockPayload
+	fp := packFingerprintFor(sqlKindManifestAndLock, sc.source, r, ai)
+	if !sc.c.get(fp, &payload) {
+		return nil, nil, false
+	}
+
+	m, l := fromCachedManifestAndLock(payload)
+	return m, l, true
+}
+
+func (sc packSingleSourceCache) setPackageTree(r Revision, pt pkgtree.PackageTree) {
+	fp := packFingerprintFor(sqlKindPackageTree, sc.source, r, ProjectAnalyzerInfo{})
+	if err := sc.c.set(fp, pt); err != nil {
+		sc.c.logger.Println("packCache: failed to store package tree:", err)
+	}
+}
+
+func (sc packSingleSourceCache) getPackageTree(r Revision, pr ProjectRoot) (pkgtree.PackageTree, bool) {
+	var pt pkgtree.PackageTree
+	fp := packFingerprintFor(sqlKindPackageTree, sc.source, r, ProjectAnalyzerInfo{})
+	if !sc.c.get(fp, &pt) {
+		return pkgtree.PackageTree{}, false
+	}
+	return pt, true
+}
+
+func (sc packSingleSourceCache) markRevisionExists(r Revision) {
+	fp := packFingerprintFor(sqlKindRevisionExists, sc.source, r, ProjectAnalyzerInfo{})
+	if err := sc.c.set(fp, true); err != nil {
+		sc.c.logger.Println("packCache: failed to mark revision as existing:", err)
+	}
+}
+
+func (sc packSingleSourceCache) setVersionMap(versionList []PairedVersion) {
+	type rawVersion struct {
+		Str string
+		Rev Revision
+		Typ VersionType
+	}
+	raws := make([]rawVersion, len(versionList))
+	for i, v := range versionList {
+		uv := v.Unpair()
+		raws[i] = rawVersion{uv.String(), v.Revision(), uv.Type()}
+	}
+
+	fp := packFingerprintFor(sqlKindVersions, sc.source, "", ProjectAnalyzerInfo{})
+	if err := sc.c.set(fp, raws); err != nil {
+		sc.c.logger.Println("packCache: failed to store version map:", err)
+	}
+}
+
+func (sc packSingleSourceCache) getAllVersions() ([]PairedVersion, bool) {
+	type rawVersion struct {
+		Str string
+		Rev Revision
+		Typ VersionType
+	}
+	var raws []rawVersion
+	fp := packFingerprintFor(sqlKindVersions, sc.source, "", ProjectAnalyzerInfo{})
+	if !sc.c.get(fp, &raws) {
+		return nil, false
+	}
+
+	out := make([]PairedVersion, len(raws))
+	for i, raw := range raws {
+		out[i] = deducePairedVersion(raw.Str, raw.Rev, raw.Typ)
+	}
+	return out, true
+}
+
+func (sc packSingleSourceCache) getVersionsFor(r Revision) ([]UnpairedVersion, bool) {
+	all, ok := sc.getAllVersions()
+	if !ok {
+		return nil, false
+	}
+	var uvs []UnpairedVersion
+	for _, pv := range all {
+		if pv.Revision() == r {
+			uvs = append(uvs, pv.Unpair())
+		}
+	}
+	return uvs, len(uvs) > 0
+}
+
+func (sc packSingleSourceCache) getRevisionFor(uv UnpairedVersion) (Revision, bool) {
+	all, ok := sc.getAllVersions()
+	if !ok {
+		return "", false
+	}
+	for _, pv := range all {
+		if pv.Unpair().identical(uv) {
+			return pv.Revision(), true
+		}
+	}
+	return "", false
+}
+
+func (sc packSingleSourceCache) toRevision(v Version) (Revision, bool) {
+	switch t := v.(type) {
+	case Revision:
+		return t, true
+	case PairedVersion:
+		return t.Revision(), true
+	case UnpairedVersion:
+		return sc.getRevisionFor(t)
+	}
+	return "", false
+}
+
+func (sc packSingleSourceCache) toUnpaired(v Version) (UnpairedVersion, bool) {
+	switch t := v.(type) {
+	case UnpairedVersion:
+		return t, true
+	case PairedVersion:
+		return t.Unpair(), true
+	case Revision:
+		uvs, ok := sc.getVersionsFor(t)
+		if !ok || len(uvs) == 0 {
+			return nil, false
+		}
+		return uvs[0], true
+	}
+	return nil, false
+}
@@ -5,14 +5,18 @@
 package gps
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"path"
 	"reflect"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/nomango/dep/gps/pkgtree"
 	"github.com/nomango/dep/internal/test"
 	"github.com/pkg/errors"
@@ -61,8 +65,41 @@ func Test_singleSourceCache(t *testing.T) {
 			return newMultiCache(discardCache{}, bc)
 		},
 	}.run)
+
+	newPack := func(t *testing.T, cachedir string) sourceCache {
+		pc, err := newPackCache(cachedir, epoch, log.New(test.Writer{TB: t}, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pc
+	}
+	t.Run("pack/keepOpen", singleSourceCacheTest{newCache: newPack}.run)
+	t.Run("pack/reOpen", singleSourceCacheTest{newCache: newPack, persistent: true}.run)
+
+	t.Run("multi/pack/reOpen", singleSourceCacheTest{
+		persistent: true,
+		newCache: func(t *testing.T, cachedir string) sourceCache {
+			pc, err := newPackCache(cachedir, epoch, log.New(test.Writer{TB: t}, "", 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return newMultiCache(memoryCache{}, pc)
+		},
+	}.run)
+
+	// extraSourceCacheTests is populated by build-tagged files (e.g.
+	// sql_cache_sqlite_test.go) that wire in a cache backend whose driver
+	// isn't always available, so it's exercised with the same reopen
+	// persistence checks as bolt/reOpen whenever that driver is present.
+	for name, newCache := range extraSourceCacheTests {
+		t.Run(name, singleSourceCacheTest{newCache: newCache, persistent: true}.run)
+	}
 }
 
+// extraSourceCacheTests holds additional singleSourceCacheTest backends
+// registered from build-tagged test files.
+var extraSourceCacheTests = map[string]func(*testing.T, string) sourceCache{}
+
 var testAnalyzerInfo = ProjectAnalyzerInfo{
 	Name:    "test-analyzer",
 	Version: 1,
@@ -412,6 +449,307 @@ func (test singleSourceCacheTest) run(t *testing.T) {
 	})
 }
 
+// Test_lruMemoryCache fills an lruMemoryCache past its byte budget and
+// verifies both that the oldest entries are evicted and that the most
+// recently used ones survive. The budget is sized for a handful of
+// entries, not a single one: a lone gob-encoded pkgtree.PackageTree of the
+// shape used below runs a few hundred bytes, so a too-small budget would
+// evict every entry as soon as it's written, never leaving anything behind
+// to assert on.
+func Test_lruMemoryCache(t *testing.T) {
+	const root = "example.com/test"
+	pi := mkPI(root).normalize()
+
+	const n = 20
+	const budget = 1024 // room for roughly a handful of entries, not all n
+
+	var evicted []lruEntryKey
+	c := newLRUMemoryCache(budget).withEvictCallback(func(pi ProjectIdentifier, rev Revision, kind string, data interface{}) {
+		evicted = append(evicted, lruEntryKey{pi: pi, rev: rev, kind: kind})
+	})
+	sc := c.newSingleSourceCache(pi)
+
+	for i := 0; i < n; i++ {
+		rev := Revision(fmt.Sprintf("rev%02d", i))
+		pt := pkgtree.PackageTree{
+			ImportRoot: root,
+			Packages: map[string]pkgtree.PackageOrErr{
+				root: {P: pkgtree.Package{ImportPath: root, Name: fmt.Sprintf("test%02d", i)}},
+			},
+		}
+		sc.setPackageTree(rev, pt)
+	}
+
+	if len(evicted) == 0 {
+		t.Fatal("expected some entries to be evicted once past the byte budget")
+	}
+	if len(evicted) >= n {
+		t.Fatalf("expected some entries to survive eviction given a multi-entry budget, but all %d were evicted", n)
+	}
+
+	if _, ok := sc.getPackageTree(Revision("rev00"), root); ok {
+		t.Error("expected oldest package tree to have been evicted")
+	}
+
+	newest := Revision(fmt.Sprintf("rev%02d", n-1))
+	if _, ok := sc.getPackageTree(newest, root); !ok {
+		t.Error("expected most recently set package tree to still be cached")
+	}
+
+	if c.curBytes > c.maxBytes {
+		t.Errorf("cache size %d exceeds budget %d after eviction", c.curBytes, c.maxBytes)
+	}
+}
+
+// Test_lruMemoryCache_singleEntryOverBudget covers the edge case where one
+// entry alone is larger than maxBytes: it must stay retrievable rather
+// than being evicted out from under the very set() call that wrote it.
+func Test_lruMemoryCache_singleEntryOverBudget(t *testing.T) {
+	const root = "example.com/test"
+	pi := mkPI(root).normalize()
+
+	c := newLRUMemoryCache(1)
+	sc := c.newSingleSourceCache(pi)
+
+	pt := pkgtree.PackageTree{
+		ImportRoot: root,
+		Packages: map[string]pkgtree.PackageOrErr{
+			root: {P: pkgtree.Package{ImportPath: root, Name: "test"}},
+		},
+	}
+	sc.setPackageTree(Revision("rev"), pt)
+
+	got, ok := sc.getPackageTree(Revision("rev"), root)
+	if !ok {
+		t.Fatal("expected a single entry larger than maxBytes to still be cached, not evicted out from under itself")
+	}
+	comparePackageTree(t, pt, got)
+}
+
+// Test_multiCache_lruDemote verifies that entries lruMemoryCache evicts
+// from a multiCache's fast tier are demoted into the slow tier by the
+// evict callback itself - synchronously, as part of the eviction - rather
+// than relying on multiCache's own (separate, debounced) async writeback
+// to eventually persist them. It deliberately never calls Flush and never
+// waits: if the oldest revision shows up in the slow tier immediately after
+// the loop, that can only be the evict callback's doing.
+func Test_multiCache_lruDemote(t *testing.T) {
+	const root = "example.com/test"
+	pi := mkPI(root).normalize()
+
+	slow := memoryCache{}
+	mc := newLRUBackedMultiCache(1024, slow)
+	defer mc.close()
+
+	c := mc.newSingleSourceCache(pi)
+	const n = 20
+	for i := 0; i < n; i++ {
+		rev := Revision(fmt.Sprintf("rev%02d", i))
+		pt := pkgtree.PackageTree{
+			ImportRoot: root,
+			Packages: map[string]pkgtree.PackageOrErr{
+				root: {P: pkgtree.Package{ImportPath: root, Name: fmt.Sprintf("test%02d", i)}},
+			},
+		}
+		c.setPackageTree(rev, pt)
+	}
+
+	if _, ok := slow.newSingleSourceCache(pi).getPackageTree(Revision("rev00"), root); !ok {
+		t.Error("expected the oldest, fast-tier-evicted package tree to have been demoted into the slow tier by the evict callback, without waiting for a flush")
+	}
+}
+
+// Test_boltCache_migration writes v1-shaped data, reopens the cache with a
+// v2 migration registered, and asserts the data survives the upgrade and
+// that the migration actually ran.
+func Test_boltCache_migration(t *testing.T) {
+	cpath, err := ioutil.TempDir("", "boltmigration")
+	if err != nil {
+		t.Fatalf("Failed to create temp cache dir: %s", err)
+	}
+
+	epoch := time.Now().Unix()
+	logger := log.New(test.Writer{TB: t}, "", 0)
+
+	bc, err := newBoltCache(cpath, epoch, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const root = "example.com/test"
+	pi := mkPI(root).normalize()
+	const rev Revision = "rev_v1"
+	pt := pkgtree.PackageTree{ImportRoot: root}
+
+	bc.newSingleSourceCache(pi).setPackageTree(rev, pt)
+
+	if err := bc.close(); err != nil {
+		t.Fatal("failed to close cache:", err)
+	}
+
+	savedMigrations := cacheMigrations
+	defer func() { cacheMigrations = savedMigrations }()
+
+	var migrated bool
+	registerCacheMigration(testMigrationV2{ran: &migrated})
+
+	bc, err = newBoltCache(cpath, epoch, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := bc.close(); err != nil {
+			t.Error("failed to close cache:", err)
+		}
+	}()
+
+	if !migrated {
+		t.Error("expected the v2 migration to run when reopening v1-shaped data")
+	}
+
+	got, ok := bc.newSingleSourceCache(pi).getPackageTree(rev, root)
+	if !ok {
+		t.Fatal("expected package tree written under schema v1 to survive migration to v2")
+	}
+	comparePackageTree(t, pt, got)
+}
+
+// testMigrationV2 is a no-op migration beyond recording that it ran; it
+// only exists to exercise the migration-running path in
+// Test_boltCache_migration.
+type testMigrationV2 struct{ ran *bool }
+
+func (testMigrationV2) Version() int { return 2 }
+
+func (m testMigrationV2) Migrate(tx *bolt.Tx) error {
+	*m.ran = true
+	return nil
+}
+
+// Test_multiCache_asyncWriteback exercises the write-back behavior added to
+// multiCache: the fast tier serves reads before the slow tier has been
+// flushed, and rapid repeated writes for the same revision coalesce into a
+// single write to the slow tier.
+func Test_multiCache_asyncWriteback(t *testing.T) {
+	const root = "example.com/test"
+	pi := mkPI(root).normalize()
+	pt := pkgtree.PackageTree{
+		ImportRoot: root,
+		Packages: map[string]pkgtree.PackageOrErr{
+			root: {P: pkgtree.Package{ImportPath: root, Name: "test"}},
+		},
+	}
+
+	t.Run("fast tier serves reads before flush", func(t *testing.T) {
+		// discardCache stands in for a slow tier whose write never lands -
+		// as if the process crashed between set and the next flush. The
+		// fast tier must still answer reads regardless.
+		mc := newMultiCache(memoryCache{}, discardCache{})
+		defer mc.close()
+
+		c := mc.newSingleSourceCache(pi)
+		c.setPackageTree(Revision("rev"), pt)
+
+		got, ok := c.getPackageTree(Revision("rev"), root)
+		if !ok {
+			t.Fatal("expected fast tier to serve the package tree before any flush")
+		}
+		comparePackageTree(t, pt, got)
+	})
+
+	t.Run("coalesces repeated writes", func(t *testing.T) {
+		cc := &countingCache{inner: memoryCache{}}
+		mc := newMultiCache(memoryCache{}, cc)
+		defer mc.close()
+
+		c := mc.newSingleSourceCache(pi)
+		const n = 50
+		for i := 0; i < n; i++ {
+			c.setPackageTree(Revision("rev"), pt)
+		}
+
+		if err := mc.Flush(context.Background()); err != nil {
+			t.Fatal("Flush failed:", err)
+		}
+
+		if got := cc.setPackageTreeCalls(); got != 1 {
+			t.Errorf("expected N identical setPackageTree calls to coalesce into 1 slow-tier write, got %d", got)
+		}
+	})
+}
+
+// countingCache wraps a sourceCache and counts calls to setPackageTree, so
+// tests can assert on how many writes actually reached the slow tier.
+type countingCache struct {
+	mu    sync.Mutex
+	n     int
+	inner sourceCache
+}
+
+func (c *countingCache) setPackageTreeCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func (c *countingCache) newSingleSourceCache(pi ProjectIdentifier) singleSourceCache {
+	return countingSingleSourceCache{c: c, inner: c.inner.newSingleSourceCache(pi)}
+}
+
+func (c *countingCache) close() error { return c.inner.close() }
+
+type countingSingleSourceCache struct {
+	c     *countingCache
+	inner singleSourceCache
+}
+
+func (c countingSingleSourceCache) setManifestAndLock(r Revision, ai ProjectAnalyzerInfo, m Manifest, l Lock) {
+	c.inner.setManifestAndLock(r, ai, m, l)
+}
+
+func (c countingSingleSourceCache) getManifestAndLock(r Revision, ai ProjectAnalyzerInfo) (Manifest, Lock, bool) {
+	return c.inner.getManifestAndLock(r, ai)
+}
+
+func (c countingSingleSourceCache) setPackageTree(r Revision, pt pkgtree.PackageTree) {
+	c.c.mu.Lock()
+	c.c.n++
+	c.c.mu.Unlock()
+	c.inner.setPackageTree(r, pt)
+}
+
+func (c countingSingleSourceCache) getPackageTree(r Revision, pr ProjectRoot) (pkgtree.PackageTree, bool) {
+	return c.inner.getPackageTree(r, pr)
+}
+
+func (c countingSingleSourceCache) markRevisionExists(r Revision) {
+	c.inner.markRevisionExists(r)
+}
+
+func (c countingSingleSourceCache) setVersionMap(versionList []PairedVersion) {
+	c.inner.setVersionMap(versionList)
+}
+
+func (c countingSingleSourceCache) getVersionsFor(r Revision) ([]UnpairedVersion, bool) {
+	return c.inner.getVersionsFor(r)
+}
+
+func (c countingSingleSourceCache) getAllVersions() ([]PairedVersion, bool) {
+	return c.inner.getAllVersions()
+}
+
+func (c countingSingleSourceCache) getRevisionFor(uv UnpairedVersion) (Revision, bool) {
+	return c.inner.getRevisionFor(uv)
+}
+
+func (c countingSingleSourceCache) toRevision(v Version) (Revision, bool) {
+	return c.inner.toRevision(v)
+}
+
+func (c countingSingleSourceCache) toUnpaired(v Version) (UnpairedVersion, bool) {
+	return c.inner.toUnpaired(v)
+}
+
 // compareManifests compares two manifests and reports differences as test errors.
 func compareManifests(t *testing.T, want, got Manifest) {
 	if (want == nil || got == nil) && (got != nil || want != nil) {
@@ -0,0 +1,498 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gps
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nomango/dep/gps/pkgtree"
+	"github.com/pkg/errors"
+)
+
+// sqlDialect captures the handful of places Postgres and SQLite disagree on
+// syntax that this cache cares about: the placeholder style and the blob
+// column type. Everything else - including the upsert statements, which
+// both support via "ON CONFLICT ... DO UPDATE SET ... excluded.col" - is
+// shared.
+type sqlDialect int
+
+const (
+	dialectSQLite sqlDialect = iota
+	dialectPostgres
+)
+
+func (d sqlDialect) blobType() string {
+	if d == dialectPostgres {
+		return "BYTEA"
+	}
+	return "BLOB"
+}
+
+// rebind rewrites a query written with "?" placeholders into the form the
+// dialect expects ("?" as-is for sqlite3, "$1", "$2", ... for postgres).
+func (d sqlDialect) rebind(query string) string {
+	if d != dialectPostgres {
+		return query
+	}
+	var buf strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			buf.WriteByte('$')
+			buf.WriteString(strconv.Itoa(n))
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// sqlCache is a sourceCache that persists the same data as boltCache -
+// manifests, locks, package trees, version maps, and revision existence -
+// into a relational database instead of a local bolt file. The point is to
+// let CI runners and developer machines share a single warm cache of
+// upstream source metadata over the network, avoiding redundant
+// `git ls-remote`/clone work per developer.
+//
+// Rows are keyed on (source_url, revision, analyzer_name, analyzer_version,
+// kind) and written with an upsert, so concurrent writers from different
+// machines are safe. epoch is stamped on every row and is used the same way
+// boltCache uses it: entries written under a different epoch are treated as
+// stale and ignored (and can be pruned later with Vacuum).
+type sqlCache struct {
+	db      *sql.DB
+	epoch   int64
+	logger  *log.Logger
+	dialect sqlDialect
+}
+
+const (
+	sqlKindManifestAndLock = "manifestAndLock"
+	sqlKindPackageTree     = "packageTree"
+	sqlKindVersions        = "versions"
+	sqlKindRevisionExists  = "revisionExists"
+)
+
+// newSQLCache wraps db in a sourceCache using the SQLite dialect ("?"
+// placeholders, BLOB columns), so db must be a SQLite database; a Postgres
+// db needs newSQLCacheDialect with dialectPostgres, as newPostgresCache
+// does. epoch plays the same role it does for newBoltCache: entries from a
+// previous epoch are no longer returned by get* calls.
+func newSQLCache(db *sql.DB, epoch int64, logger *log.Logger) (*sqlCache, error) {
+	return newSQLCacheDialect(db, epoch, logger, dialectSQLite)
+}
+
+func newSQLCacheDialect(db *sql.DB, epoch int64, logger *log.Logger, dialect sqlDialect) (*sqlCache, error) {
+	if logger == nil {
+		logger = log.New(ioutilDiscard{}, "", 0)
+	}
+	c := &sqlCache{db: db, epoch: epoch, logger: logger, dialect: dialect}
+	if err := c.createSchema(); err != nil {
+		return nil, errors.Wrap(err, "sqlCache: failed to create schema")
+	}
+	return c, nil
+}
+
+// ioutilDiscard avoids importing io/ioutil just for a default logger sink.
+type ioutilDiscard struct{}
+
+func (ioutilDiscard) Write(p []byte) (int, error) { return len(p), nil }
+
+// createSchema creates the cache tables if they don't exist yet. It tracks
+// the same currentCacheSchemaVersion() number boltCache's cacheMigration
+// registry targets, but cacheMigration.Migrate takes a *bolt.Tx, so the
+// registry itself only runs against boltCache - sqlCache cannot execute a
+// registered migration and does not claim to. All createSchema can
+// honestly do on a version mismatch, in either direction, is treat
+// gps_cache_entries as unreadable and wipe it: a recorded version newer
+// than this binary's may use columns or encoding it doesn't understand,
+// and a recorded version older than this binary's has no migration path
+// to the current shape to fall back on (unlike bolt, which can actually
+// run the missing migrations). Leaving stale rows in place either way
+// would mean every future get* silently logs a decode failure forever,
+// which is worse than losing the cached data and rebuilding it.
+func (c *sqlCache) createSchema() error {
+	schema := fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS gps_cache_entries (
+	source_url       TEXT      NOT NULL,
+	revision         TEXT      NOT NULL,
+	analyzer_name    TEXT      NOT NULL,
+	analyzer_version INTEGER   NOT NULL,
+	kind             TEXT      NOT NULL,
+	epoch            BIGINT    NOT NULL,
+	data             %s        NOT NULL,
+	updated_at       TIMESTAMP NOT NULL,
+	PRIMARY KEY (source_url, revision, analyzer_name, analyzer_version, kind)
+);
+`, c.dialect.blobType())
+	if _, err := c.db.Exec(schema); err != nil {
+		return err
+	}
+
+	if _, err := c.db.Exec(`
+CREATE TABLE IF NOT EXISTS gps_cache_schema (
+	name    TEXT    NOT NULL PRIMARY KEY,
+	version INTEGER NOT NULL
+);
+`); err != nil {
+		return err
+	}
+
+	target := currentCacheSchemaVersion()
+	rows, err := c.query(`SELECT version FROM gps_cache_schema WHERE name = ?`, "gps_cache_entries")
+	if err != nil {
+		return err
+	}
+	var recorded int
+	hasRecorded := rows.Next()
+	if hasRecorded {
+		err = rows.Scan(&recorded)
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	if hasRecorded && recorded != target {
+		c.logger.Printf("sqlCache: on-disk schema version %d does not match this binary's %d; rebuilding gps_cache_entries", recorded, target)
+		if _, err := c.db.Exec(`DELETE FROM gps_cache_entries`); err != nil {
+			return err
+		}
+	}
+
+	_, err = c.exec(`
+INSERT INTO gps_cache_schema (name, version) VALUES (?, ?)
+ON CONFLICT (name) DO UPDATE SET version = excluded.version
+`, "gps_cache_entries", target)
+	return err
+}
+
+func (c *sqlCache) exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.db.Exec(c.dialect.rebind(query), args...)
+}
+
+func (c *sqlCache) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.Query(c.dialect.rebind(query), args...)
+}
+
+func (c *sqlCache) upsert(sourceURL string, rev Revision, ai ProjectAnalyzerInfo, kind string, data []byte, now time.Time) error {
+	_, err := c.exec(`
+INSERT INTO gps_cache_entries (source_url, revision, analyzer_name, analyzer_version, kind, epoch, data, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (source_url, revision, analyzer_name, analyzer_version, kind)
+DO UPDATE SET epoch = excluded.epoch, data = excluded.data, updated_at = excluded.updated_at
+`, sourceURL, string(rev), ai.Name, ai.Version, kind, c.epoch, data, now)
+	return err
+}
+
+func (c *sqlCache) lookup(sourceURL string, rev Revision, ai ProjectAnalyzerInfo, kind string) ([]byte, bool) {
+	rows, err := c.query(`
+SELECT data FROM gps_cache_entries
+WHERE source_url = ? AND revision = ? AND analyzer_name = ? AND analyzer_version = ? AND kind = ? AND epoch = ?
+`, sourceURL, string(rev), ai.Name, ai.Version, kind, c.epoch)
+	if err != nil {
+		c.logger.Println("sqlCache: lookup failed:", err)
+		return nil, false
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, false
+	}
+	var data []byte
+	if err := rows.Scan(&data); err != nil {
+		c.logger.Println("sqlCache: scan failed:", err)
+		return nil, false
+	}
+	return data, true
+}
+
+// Vacuum prunes rows stamped with an epoch other than c.epoch that haven't
+// been touched since before olderThan, so a long-lived shared cache doesn't
+// grow forever with data from gps versions nobody uses anymore.
+func (c *sqlCache) Vacuum(olderThan time.Time) error {
+	_, err := c.exec(`DELETE FROM gps_cache_entries WHERE epoch != ? AND updated_at < ?`, c.epoch, olderThan)
+	return err
+}
+
+func (c *sqlCache) newSingleSourceCache(pi ProjectIdentifier) singleSourceCache {
+	return sqlSingleSourceCache{c: c, source: string(pi.ProjectRoot)}
+}
+
+func (c *sqlCache) close() error {
+	return c.db.Close()
+}
+
+type sqlSingleSourceCache struct {
+	c      *sqlCache
+	source string
+}
+
+// cachedManifest and cachedLock mirror the shape boltCache already
+// gob-encodes manifests and locks into; they're stored here as opaque blobs
+// too, since gps only ever consumes them back through the Manifest/Lock
+// interfaces.
+type cachedManifest struct {
+	Constraints ProjectConstraints
+	Overrides   ProjectConstraints
+	Ignored     []string
+	Required    []string
+}
+
+type cachedLock struct {
+	Projects []LockedProject
+}
+
+// manifestAndLockPayload is the gob-friendly shape all three
+// singleSourceCache backends store a Manifest/Lock pair as - it's the
+// payload type shared by toCachedManifestAndLock/fromCachedManifestAndLock
+// below, so the three backends only differ in how they get the bytes (or,
+// for packCache, the struct itself) in and out of storage.
+type manifestAndLockPayload struct {
+	M cachedManifest
+	L cachedLock
+}
+
+// toCachedManifestAndLock flattens m and l into the gob-friendly shape
+// backends persist, capturing the root-only fields (overrides, ignores,
+// required packages) when m is a RootManifest.
+func toCachedManifestAndLock(m Manifest, l Lock) manifestAndLockPayload {
+	cm := cachedManifest{Constraints: m.DependencyConstraints()}
+	if rm, ok := m.(RootManifest); ok {
+		cm.Overrides = rm.Overrides()
+		cm.Ignored = rm.IgnoredPackages().ToSlice()
+		for pkg, req := range rm.RequiredPackages() {
+			if req {
+				cm.Required = append(cm.Required, pkg)
+			}
+		}
+	}
+	cl := cachedLock{}
+	if l != nil {
+		cl.Projects = l.Projects()
+	}
+	return manifestAndLockPayload{M: cm, L: cl}
+}
+
+// fromCachedManifestAndLock reconstructs a Manifest/Lock pair from a
+// payload previously produced by toCachedManifestAndLock.
+func fromCachedManifestAndLock(payload manifestAndLockPayload) (Manifest, Lock) {
+	req := make(map[string]bool, len(payload.M.Required))
+	for _, pkg := range payload.M.Required {
+		req[pkg] = true
+	}
+	m := &simpleRootManifest{
+		c:   payload.M.Constraints,
+		ovr: payload.M.Overrides,
+		req: req,
+		ig:  pkgtree.NewIgnoredRuleset(payload.M.Ignored),
+	}
+	l := &safeLock{p: payload.L.Projects}
+	return m, l
+}
+
+// encodeManifestAndLock gob-encodes m and l in the shape sql/bolt caches
+// store as an opaque blob.
+func encodeManifestAndLock(m Manifest, l Lock) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(toCachedManifestAndLock(m, l)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeManifestAndLock is the inverse of encodeManifestAndLock.
+func decodeManifestAndLock(data []byte) (Manifest, Lock, error) {
+	var payload manifestAndLockPayload
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&payload); err != nil {
+		return nil, nil, err
+	}
+	m, l := fromCachedManifestAndLock(payload)
+	return m, l, nil
+}
+
+func (sc sqlSingleSourceCache) setManifestAndLock(r Revision, ai ProjectAnalyzerInfo, m Manifest, l Lock) {
+	data, err := encodeManifestAndLock(m, l)
+	if err != nil {
+		sc.c.logger.Println("sqlCache: failed to encode manifest and lock:", err)
+		return
+	}
+
+	if err := sc.c.upsert(sc.source, r, ai, sqlKindManifestAndLock, data, now()); err != nil {
+		sc.c.logger.Println("sqlCache: failed to store manifest and lock:", err)
+	}
+}
+
+func (sc sqlSingleSourceCache) getManifestAndLock(r Revision, ai ProjectAnalyzerInfo) (Manifest, Lock, bool) {
+	data, ok := sc.c.lookup(sc.source, r, ai, sqlKindManifestAndLock)
+	if !ok {
+		return nil, nil, false
+	}
+
+	m, l, err := decodeManifestAndLock(data)
+	if err != nil {
+		sc.c.logger.Println("sqlCache: failed to decode manifest and lock:", err)
+		return nil, nil, false
+	}
+	return m, l, true
+}
+
+func (sc sqlSingleSourceCache) setPackageTree(r Revision, pt pkgtree.PackageTree) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(pt); err != nil {
+		sc.c.logger.Println("sqlCache: failed to encode package tree:", err)
+		return
+	}
+	if err := sc.c.upsert(sc.source, r, ProjectAnalyzerInfo{}, sqlKindPackageTree, buf.Bytes(), now()); err != nil {
+		sc.c.logger.Println("sqlCache: failed to store package tree:", err)
+	}
+}
+
+func (sc sqlSingleSourceCache) getPackageTree(r Revision, pr ProjectRoot) (pkgtree.PackageTree, bool) {
+	data, ok := sc.c.lookup(sc.source, r, ProjectAnalyzerInfo{}, sqlKindPackageTree)
+	if !ok {
+		return pkgtree.PackageTree{}, false
+	}
+	var pt pkgtree.PackageTree
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&pt); err != nil {
+		sc.c.logger.Println("sqlCache: failed to decode package tree:", err)
+		return pkgtree.PackageTree{}, false
+	}
+	return pt, true
+}
+
+func (sc sqlSingleSourceCache) markRevisionExists(r Revision) {
+	if err := sc.c.upsert(sc.source, r, ProjectAnalyzerInfo{}, sqlKindRevisionExists, []byte{1}, now()); err != nil {
+		sc.c.logger.Println("sqlCache: failed to mark revision as existing:", err)
+	}
+}
+
+func (sc sqlSingleSourceCache) setVersionMap(versionList []PairedVersion) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(len(versionList)); err != nil {
+		sc.c.logger.Println("sqlCache: failed to encode version map:", err)
+		return
+	}
+	for _, v := range versionList {
+		uv := v.Unpair()
+		if err := enc.Encode(struct {
+			Str string
+			Rev Revision
+			Typ VersionType
+		}{uv.String(), v.Revision(), uv.Type()}); err != nil {
+			sc.c.logger.Println("sqlCache: failed to encode version map:", err)
+			return
+		}
+	}
+	if err := sc.c.upsert(sc.source, "", ProjectAnalyzerInfo{}, sqlKindVersions, buf.Bytes(), now()); err != nil {
+		sc.c.logger.Println("sqlCache: failed to store version map:", err)
+	}
+}
+
+func (sc sqlSingleSourceCache) getAllVersions() ([]PairedVersion, bool) {
+	data, ok := sc.c.lookup(sc.source, "", ProjectAnalyzerInfo{}, sqlKindVersions)
+	if !ok {
+		return nil, false
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	var n int
+	if err := dec.Decode(&n); err != nil {
+		sc.c.logger.Println("sqlCache: failed to decode version map:", err)
+		return nil, false
+	}
+
+	out := make([]PairedVersion, 0, n)
+	for i := 0; i < n; i++ {
+		var raw struct {
+			Str string
+			Rev Revision
+			Typ VersionType
+		}
+		if err := dec.Decode(&raw); err != nil {
+			sc.c.logger.Println("sqlCache: failed to decode version map:", err)
+			return nil, false
+		}
+		out = append(out, deducePairedVersion(raw.Str, raw.Rev, raw.Typ))
+	}
+	return out, true
+}
+
+// deducePairedVersion reconstructs the UnpairedVersion that str/typ describe
+// and pairs it back up with rev.
+func deducePairedVersion(str string, rev Revision, typ VersionType) PairedVersion {
+	if typ == IsBranch {
+		return NewBranch(str).Pair(rev)
+	}
+	return NewVersion(str).Pair(rev)
+}
+
+func (sc sqlSingleSourceCache) getVersionsFor(r Revision) ([]UnpairedVersion, bool) {
+	all, ok := sc.getAllVersions()
+	if !ok {
+		return nil, false
+	}
+	var uvs []UnpairedVersion
+	for _, pv := range all {
+		if pv.Revision() == r {
+			uvs = append(uvs, pv.Unpair())
+		}
+	}
+	return uvs, len(uvs) > 0
+}
+
+func (sc sqlSingleSourceCache) getRevisionFor(uv UnpairedVersion) (Revision, bool) {
+	all, ok := sc.getAllVersions()
+	if !ok {
+		return "", false
+	}
+	for _, pv := range all {
+		if pv.Unpair().identical(uv) {
+			return pv.Revision(), true
+		}
+	}
+	return "", false
+}
+
+func (sc sqlSingleSourceCache) toRevision(v Version) (Revision, bool) {
+	switch t := v.(type) {
+	case Revision:
+		return t, true
+	case PairedVersion:
+		return t.Revision(), true
+	case UnpairedVersion:
+		return sc.getRevisionFor(t)
+	}
+	return "", false
+}
+
+func (sc sqlSingleSourceCache) toUnpaired(v Version) (UnpairedVersion, bool) {
+	switch t := v.(type) {
+	case UnpairedVersion:
+		return t, true
+	case PairedVersion:
+		return t.Unpair(), true
+	case Revision:
+		uvs, ok := sc.getVersionsFor(t)
+		if !ok || len(uvs) == 0 {
+			return nil, false
+		}
+		return uvs[0], true
+	}
+	return nil, false
+}
+
+// now is a seam over time.Now, used for every updated_at value the SQL
+// backend writes, so a test can hold the clock still by replacing it.
+var now = time.Now
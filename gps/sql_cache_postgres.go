@@ -0,0 +1,26 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build postgres
+
+package gps
+
+import (
+	"database/sql"
+	"log"
+
+	_ "github.com/lib/pq"
+)
+
+// newPostgresCache opens a connection to dsn and wraps it in a sqlCache,
+// for the shared-team-cache case where many developers and CI runners
+// point at one Postgres instance. Built only when gps is compiled with the
+// postgres tag.
+func newPostgresCache(dsn string, epoch int64, logger *log.Logger) (*sqlCache, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLCacheDialect(db, epoch, logger, dialectPostgres)
+}
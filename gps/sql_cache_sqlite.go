@@ -0,0 +1,25 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build sqlite3
+
+package gps
+
+import (
+	"database/sql"
+	"log"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newSQLiteCache opens (creating if necessary) the SQLite database at path
+// and wraps it in a sqlCache. It's built only when gps is compiled with the
+// sqlite3 tag, since the driver requires cgo.
+func newSQLiteCache(path string, epoch int64, logger *log.Logger) (*sqlCache, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLCacheDialect(db, epoch, logger, dialectSQLite)
+}
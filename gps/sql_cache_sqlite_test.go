@@ -0,0 +1,27 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build sqlite3
+
+package gps
+
+import (
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nomango/dep/internal/test"
+)
+
+func init() {
+	epoch := time.Now().Unix()
+	extraSourceCacheTests["sql/sqlite"] = func(t *testing.T, cachedir string) sourceCache {
+		sc, err := newSQLiteCache(filepath.Join(cachedir, "cache.sqlite3"), epoch, log.New(test.Writer{TB: t}, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newMultiCache(memoryCache{}, sc)
+	}
+}